@@ -0,0 +1,59 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import "context"
+
+// Build statuses.
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+	StatusKilled  = "killed"
+	StatusError   = "error"
+)
+
+// Build represents a pipeline build.
+type Build struct {
+	ID       int64  `json:"id"`
+	RepoID   int64  `json:"repo_id"`
+	Number   int64  `json:"number"`
+	Status   string `json:"status"`
+	Created  int64  `json:"created"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+}
+
+// IsDone returns true if the build has finished executing and has
+// reached a terminal status.
+func (b *Build) IsDone() bool {
+	switch b.Status {
+	case StatusPending, StatusRunning:
+		return false
+	default:
+		return true
+	}
+}
+
+// BuildStore persists and queries build records.
+type BuildStore interface {
+	// Pending returns a list of builds pending execution.
+	Pending(ctx context.Context) ([]*Build, error)
+	// Running returns a list of builds in a running state.
+	Running(ctx context.Context) ([]*Build, error)
+	// Update persists changes to a build record.
+	Update(ctx context.Context, build *Build) error
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// Repository represents a source code repository.
+type Repository struct {
+	ID      int64  `json:"id"`
+	UID     string `json:"uid"`
+	Slug    string `json:"slug"`
+	Timeout int64  `json:"timeout"` // Timeout is the per-stage execution timeout, in minutes.
+
+	// PendingTimeout overrides the reaper's global pending deadline
+	// for this repository. Repositories that legitimately queue for
+	// a long time (release pipelines, scheduled jobs) can set this
+	// higher than the default, while repositories that should fail
+	// fast can set it lower. Persisted on the repository record and
+	// editable through the repository API; a zero value defers to
+	// QueueTimeout, then to the reaper's global default.
+	PendingTimeout time.Duration `json:"pending_timeout"`
+
+	// QueueTimeout is the pending deadline inherited from the
+	// repository's default pipeline configuration (intended to be
+	// the queue_timeout key in the pipeline YAML, populated by the
+	// pipeline config parser at build creation time). Nothing in
+	// this tree parses that key yet, so the field is currently only
+	// ever set directly on the Repository record; it is consulted
+	// after PendingTimeout and before the reaper's global default.
+	QueueTimeout time.Duration `json:"queue_timeout"`
+}
+
+// RepositoryStore persists and queries repository records.
+type RepositoryStore interface {
+	// Find returns a repository by internal ID.
+	Find(ctx context.Context, id int64) (*Repository, error)
+}
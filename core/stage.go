@@ -0,0 +1,44 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import "context"
+
+// Stage represents a stage of a build pipeline.
+type Stage struct {
+	ID      int64  `json:"id"`
+	BuildID int64  `json:"build_id"`
+	Status  string `json:"status"`
+	Started int64  `json:"started"`
+}
+
+// IsDone returns true if the stage has finished executing and has
+// reached a terminal status.
+func (s *Stage) IsDone() bool {
+	switch s.Status {
+	case StatusPending, StatusRunning:
+		return false
+	default:
+		return true
+	}
+}
+
+// StageStore persists and queries stage records.
+type StageStore interface {
+	// List returns the stages associated with the build.
+	List(ctx context.Context, buildID int64) ([]*Stage, error)
+	// Update persists changes to a stage record.
+	Update(ctx context.Context, stage *Stage) error
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reaper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventAction describes what the reaper did, or decided not to do,
+// when it inspected a build.
+type EventAction string
+
+// EventAction values.
+const (
+	EventSkipped   EventAction = "skipped"
+	EventCancelled EventAction = "cancelled"
+	EventDryRun    EventAction = "dry_run"
+)
+
+// EventReason describes why the reaper took an EventAction.
+type EventReason string
+
+// EventReason values.
+const (
+	ReasonPendingExceeded  EventReason = "pending_exceeded"
+	ReasonStageTimeout     EventReason = "stage_timeout"
+	ReasonAllStagesPending EventReason = "all_stages_pending"
+
+	// ReasonDeadlineNotReached is reported when the reaper inspects
+	// a build that has not yet exceeded its pending or running
+	// deadline, so no policy is consulted.
+	ReasonDeadlineNotReached EventReason = "deadline_not_reached"
+
+	// ReasonCapped is reported when a policy such as
+	// MaxConcurrentCancelsPolicy would have cancelled the build but
+	// suppressed the cancel because the per-tick cap was reached.
+	ReasonCapped EventReason = "capped"
+)
+
+// Event is emitted by the reaper each time it inspects, skips or
+// cancels a build, so that observers such as an admin dashboard or
+// external monitoring can follow along without polling.
+type Event struct {
+	BuildID  int64
+	RepoID   int64
+	Repo     string
+	Action   EventAction
+	Reason   EventReason
+	Deadline time.Duration
+	Created  int64
+}
+
+// Eventer publishes reaper events to subscribers.
+type Eventer interface {
+	Publish(ctx context.Context, event *Event)
+}
+
+// eventRing is a fixed-capacity, retention-bounded buffer of recent
+// events, so that a subscriber connecting after the fact can fetch
+// a backlog instead of missing everything that already happened.
+type eventRing struct {
+	sync.Mutex
+
+	items []*Event
+	size  int
+}
+
+func newEventRing(size int) *eventRing {
+	if size <= 0 {
+		size = 256
+	}
+	return &eventRing{size: size}
+}
+
+func (r *eventRing) push(event *Event) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.items = append(r.items, event)
+	if extra := len(r.items) - r.size; extra > 0 {
+		r.items = r.items[extra:]
+	}
+}
+
+// recent returns the events currently retained in the ring, oldest
+// first.
+func (r *eventRing) recent() []*Event {
+	r.Lock()
+	defer r.Unlock()
+
+	out := make([]*Event, len(r.items))
+	copy(out, r.items)
+	return out
+}
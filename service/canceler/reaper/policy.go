@@ -0,0 +1,159 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reaper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/drone/drone/core"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Action is the decision a ReapPolicy makes about a build.
+type Action int
+
+// Action values.
+const (
+	// ActionNone leaves the build alone.
+	ActionNone Action = iota
+	// ActionCancel cancels the build.
+	ActionCancel
+	// ActionDryRun would have cancelled the build, but did not,
+	// because the policy is running in dry-run mode.
+	ActionDryRun
+)
+
+// ReapPolicy decides whether a build that has exceeded its deadline
+// should actually be cancelled. Policies are evaluated in order; the
+// first to return an action other than ActionNone wins. deadline is
+// the pending or running deadline that triggered the evaluation; a
+// policy whose decision is based on a different deadline (such as a
+// per-stage timeout) returns that deadline instead, so the reaper can
+// report the deadline that was actually applied.
+type ReapPolicy interface {
+	Evaluate(ctx context.Context, repo *core.Repository, build *core.Build, stages []*core.Stage, deadline time.Duration) (Action, EventReason, time.Duration)
+}
+
+// defaultPolicies is used when a Reaper is not configured with any
+// explicit Policies.
+var defaultPolicies = []ReapPolicy{DefaultPolicy{}}
+
+// DefaultPolicy implements the reaper's original decision logic: a
+// build that is still pending is cancelled outright, a build whose
+// stages are all pending is cancelled, and a build whose running
+// stage has exceeded the repository's stage timeout is cancelled.
+type DefaultPolicy struct{}
+
+// Evaluate implements ReapPolicy.
+func (DefaultPolicy) Evaluate(ctx context.Context, repo *core.Repository, build *core.Build, stages []*core.Stage, deadline time.Duration) (Action, EventReason, time.Duration) {
+	if build.Status == core.StatusPending {
+		return ActionCancel, ReasonPendingExceeded, deadline
+	}
+
+	var started int64
+	for _, stage := range stages {
+		if stage.IsDone() {
+			continue
+		}
+		if stage.Started > started {
+			started = stage.Started
+		}
+	}
+
+	if started == 0 {
+		return ActionCancel, ReasonAllStagesPending, deadline
+	}
+
+	stageTimeout := time.Duration(repo.Timeout) * time.Minute
+	if isExceeded(started, stageTimeout, buffer) {
+		return ActionCancel, ReasonStageTimeout, stageTimeout
+	}
+
+	return ActionNone, "", deadline
+}
+
+// DryRunPolicy wraps another ReapPolicy and turns any ActionCancel
+// decision into ActionDryRun, so the wrapped policy's reasoning is
+// still logged and emitted as an event, but no build is ever
+// actually cancelled. This is useful for running a new policy in
+// shadow mode before trusting it to kill real builds.
+type DryRunPolicy struct {
+	Policy ReapPolicy
+}
+
+// Evaluate implements ReapPolicy.
+func (p DryRunPolicy) Evaluate(ctx context.Context, repo *core.Repository, build *core.Build, stages []*core.Stage, deadline time.Duration) (Action, EventReason, time.Duration) {
+	action, reason, applied := p.Policy.Evaluate(ctx, repo, build, stages, deadline)
+	if action == ActionCancel {
+		logrus.WithFields(logrus.Fields{
+			"repo":   repo.Slug,
+			"build":  build.Number,
+			"reason": reason,
+		}).Infoln("reaper: dry run, build would be cancelled")
+		return ActionDryRun, reason, applied
+	}
+	return action, reason, applied
+}
+
+// MaxConcurrentCancelsPolicy wraps another ReapPolicy and caps the
+// number of cancels it will allow per reap tick, so a single bad
+// pass can't kill an unbounded number of builds at once. The
+// counter is reset at the start of every tick; this is only safe
+// because the Reaper guarantees reap passes never overlap, so a
+// reset can never race with the pass it belongs to.
+type MaxConcurrentCancelsPolicy struct {
+	Policy ReapPolicy
+	Max    int
+
+	mu      sync.Mutex
+	cancels int
+}
+
+// Evaluate implements ReapPolicy.
+func (p *MaxConcurrentCancelsPolicy) Evaluate(ctx context.Context, repo *core.Repository, build *core.Build, stages []*core.Stage, deadline time.Duration) (Action, EventReason, time.Duration) {
+	action, reason, applied := p.Policy.Evaluate(ctx, repo, build, stages, deadline)
+	if action != ActionCancel {
+		return action, reason, applied
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancels >= p.Max {
+		// the build does warrant a cancel, but the tick's cap is
+		// already spent; report ReasonCapped rather than the
+		// wrapped policy's cancel reason, since the build was not
+		// actually cancelled for that reason.
+		return ActionNone, ReasonCapped, applied
+	}
+	p.cancels++
+	return ActionCancel, reason, applied
+}
+
+// Reset implements the resettablePolicy interface.
+func (p *MaxConcurrentCancelsPolicy) Reset() {
+	p.mu.Lock()
+	p.cancels = 0
+	p.mu.Unlock()
+}
+
+// resettablePolicy is implemented by policies, such as
+// MaxConcurrentCancelsPolicy, that carry state which must be reset
+// between reap ticks.
+type resettablePolicy interface {
+	Reset()
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reaper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/drone/drone/core"
+)
+
+func TestDefaultPolicyNoAction(t *testing.T) {
+	repo := &core.Repository{Timeout: 60}
+	build := &core.Build{Status: core.StatusRunning}
+	stages := []*core.Stage{{Status: core.StatusRunning, Started: time.Now().Unix()}}
+
+	action, reason, _ := DefaultPolicy{}.Evaluate(context.Background(), repo, build, stages, time.Hour)
+	if action != ActionNone {
+		t.Fatalf("expected ActionNone, got %v", action)
+	}
+	if reason != "" {
+		t.Fatalf("expected no reason to be stamped on a skipped build, got %q", reason)
+	}
+}
+
+func TestDefaultPolicyStageTimeoutReportsStageDeadline(t *testing.T) {
+	repo := &core.Repository{Timeout: 5}
+	build := &core.Build{Status: core.StatusRunning}
+	stages := []*core.Stage{{Status: core.StatusRunning, Started: 1}}
+
+	action, reason, deadline := DefaultPolicy{}.Evaluate(context.Background(), repo, build, stages, time.Hour)
+	if action != ActionCancel || reason != ReasonStageTimeout {
+		t.Fatalf("expected a stage timeout cancel, got %v/%v", action, reason)
+	}
+	if want := 5 * time.Minute; deadline != want {
+		t.Fatalf("expected the reported deadline to be the stage timeout %v, got %v", want, deadline)
+	}
+}
+
+func TestMaxConcurrentCancelsPolicyCapsCancels(t *testing.T) {
+	policy := &MaxConcurrentCancelsPolicy{Policy: DefaultPolicy{}, Max: 1}
+	policy.Reset()
+
+	repo := &core.Repository{}
+	build := &core.Build{Status: core.StatusPending}
+
+	action, _, _ := policy.Evaluate(context.Background(), repo, build, nil, time.Hour)
+	if action != ActionCancel {
+		t.Fatalf("expected the first cancel to be allowed, got %v", action)
+	}
+
+	action, reason, _ := policy.Evaluate(context.Background(), repo, build, nil, time.Hour)
+	if action != ActionNone {
+		t.Fatalf("expected the second cancel to be capped, got %v", action)
+	}
+	if reason != ReasonCapped {
+		t.Fatalf("expected a capped reason, not the wrapped policy's cancel reason, got %q", reason)
+	}
+
+	policy.Reset()
+
+	action, _, _ = policy.Evaluate(context.Background(), repo, build, nil, time.Hour)
+	if action != ActionCancel {
+		t.Fatalf("expected a cancel to be allowed again after Reset, got %v", action)
+	}
+}
@@ -16,11 +16,14 @@ package reaper
 
 import (
 	"context"
+	"errors"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/drone/drone/core"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 )
 
@@ -33,6 +36,27 @@ type Reaper struct {
 	Canceler core.Canceler
 	Pending  time.Duration // Pending is the pending pipeline deadline
 	Running  time.Duration // Running is the running pipeline deadline
+
+	// Events, if set, is notified every time the reaper inspects,
+	// skips or cancels a build. It is optional; the reaper always
+	// retains a short backlog of recent events internally so that
+	// newly connected subscribers can catch up via Recent.
+	Events Eventer
+
+	// Policies decides whether a build that has exceeded its
+	// deadline is actually cancelled. Policies are evaluated in
+	// order and the first to return a decisive action wins. If
+	// empty, DefaultPolicy is used.
+	Policies []ReapPolicy
+
+	ring     *eventRing
+	stop     chan struct{}
+	stopOnce sync.Once
+	closed   chan struct{}
+	wg       sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
 }
 
 // New returns a new Reaper.
@@ -57,24 +81,93 @@ func New(
 		Canceler: canceler,
 		Pending:  pending,
 		Running:  running,
+		ring:     newEventRing(256),
+		stop:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Recent returns the most recently emitted reap events, oldest
+// first, so that a subscriber connecting after the fact can catch
+// up on recent reaper activity instead of polling.
+func (r *Reaper) Recent() []*Event {
+	return r.ring.recent()
+}
+
+// emit records the event in the retention-bounded ring and, if an
+// Eventer is configured, publishes it to subscribers.
+func (r *Reaper) emit(ctx context.Context, event *Event) {
+	r.ring.push(event)
+	if r.Events != nil {
+		r.Events.Publish(ctx, event)
 	}
 }
 
-// Start starts the reaper.
+// Start starts the reaper. Start blocks until the context is
+// cancelled or Stop is called, and does not return until any
+// in-progress reap pass has finished, so that it never abandons a
+// build half-transitioned between states. Reap passes never overlap:
+// each tick waits for the previous pass to finish before the next
+// one can begin.
+//
+// The wg tracks the single in-progress reap pass, if any, and is
+// only ever touched from this goroutine; Stop never calls wg.Wait
+// itself; it instead waits on closed, which this method closes after
+// wg.Wait has returned. This avoids the Add-concurrent-with-Wait
+// misuse that sync.WaitGroup forbids.
 func (r *Reaper) Start(ctx context.Context, dur time.Duration) error {
+	defer close(r.closed)
+
 	ticker := time.NewTicker(dur)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			r.wg.Wait()
+			return r.join(ctx.Err())
+		case <-r.stop:
+			r.wg.Wait()
+			return r.join(nil)
 		case <-ticker.C:
-			r.reap(ctx)
+			r.wg.Add(1)
+			err := r.reap(ctx)
+			r.wg.Done()
+			if err != nil {
+				r.mu.Lock()
+				r.err = multierror.Append(r.err, err)
+				r.mu.Unlock()
+			}
 		}
 	}
 }
 
+// Stop signals the reaper to stop and blocks until Start has
+// returned, which only happens once any in-progress reap pass has
+// finished, or until the context deadline is reached, whichever
+// comes first. Stop is safe to call multiple times.
+func (r *Reaper) Stop(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+
+	select {
+	case <-r.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// join combines cause, if any, with the errors accumulated from
+// every reap pass that Start has run, and clears them.
+func (r *Reaper) join(cause error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := multierror.Append(r.err, cause)
+	r.err = nil
+	return err.ErrorOrNil()
+}
+
 func (r *Reaper) reap(ctx context.Context) error {
 	defer func() {
 		// taking the paranoid approach to recover from
@@ -85,8 +178,11 @@ func (r *Reaper) reap(ctx context.Context) error {
 		}
 	}()
 
-	// TODO debug log entry
-	// TODO use multierror
+	logrus.Debugln("reaper: starting reap pass")
+
+	r.resetPolicies()
+
+	var result *multierror.Error
 
 	pending, err := r.Builds.Pending(ctx)
 	if err != nil {
@@ -95,18 +191,34 @@ func (r *Reaper) reap(ctx context.Context) error {
 		return err
 	}
 	for _, build := range pending {
+		// the repository is looked up unconditionally, even for a
+		// build nowhere near its deadline, because the deadline
+		// itself is not known until PendingTimeout and QueueTimeout
+		// are read off the repository record; there is no cheaper
+		// global check that wouldn't risk ignoring a repository
+		// whose override fires sooner than the reaper's default.
+		repo, err := r.Repos.Find(ctx, build.RepoID)
+		if err != nil {
+			logrus.WithError(err).
+				Errorf("reaper: cannot find repository")
+			result = multierror.Append(result, err)
+			continue
+		}
+
 		// if a build is pending for longer than the maximum
-		// pending time limit, the build is maybe cancelled.
-		if isExceeded(build.Created, r.Pending, buffer) {
-			// TODO debug log entry
-			err = r.reapMaybe(ctx, build)
-			if err != nil {
-				// TODO error log entry
-				return err
+		// pending time limit, the build is maybe cancelled. the
+		// limit may be overridden per-repository to accommodate
+		// pipelines that are expected to queue longer or shorter
+		// than the global default.
+		deadline := r.pendingTimeout(repo)
+		if isExceeded(build.Created, deadline, buffer) {
+			if err := r.reapMaybe(ctx, repo, build, deadline); err != nil {
+				logrus.WithError(err).
+					Errorf("reaper: cannot reap pending build")
+				result = multierror.Append(result, err)
 			}
-			// TODO debug log entry
 		} else {
-			// TODO trace log entry
+			r.emitInspected(ctx, repo, build, deadline)
 		}
 	}
 
@@ -114,69 +226,194 @@ func (r *Reaper) reap(ctx context.Context) error {
 	if err != nil {
 		logrus.WithError(err).
 			Errorf("reaper: cannot get running builds")
-		return err
+		return multierror.Append(result, err).ErrorOrNil()
 	}
 	for _, build := range running {
+		repo, err := r.Repos.Find(ctx, build.RepoID)
+		if err != nil {
+			logrus.WithError(err).
+				Errorf("reaper: cannot find repository")
+			result = multierror.Append(result, err)
+			continue
+		}
+
 		// if a build is running for longer than the maximum
 		// running time limit, the build is maybe cancelled.
 		if isExceeded(build.Started, r.Running, buffer) {
-			// TODO debug log entry
-			err = r.reapMaybe(ctx, build)
-			if err != nil {
-				// TODO error log entry
-				return err
+			if err := r.reapMaybe(ctx, repo, build, r.Running); err != nil {
+				logrus.WithError(err).
+					Errorf("reaper: cannot reap running build")
+				result = multierror.Append(result, err)
 			}
-			// TODO debug log entry
 		} else {
-			// TODO trace log entry
+			r.emitInspected(ctx, repo, build, r.Running)
 		}
 	}
 
-	return nil
+	return result.ErrorOrNil()
 }
 
-func (r *Reaper) reapMaybe(ctx context.Context, build *core.Build) error {
-	repo, err := r.Repos.Find(ctx, build.RepoID)
-	if err != nil {
+// emitInspected records that the reaper looked at a build and found
+// it within its deadline, so it was skipped without consulting any
+// ReapPolicy. This is the "inspected" half of the event stream;
+// reapMaybe emits the "skipped" and "cancelled" events for builds
+// that have already exceeded their deadline.
+func (r *Reaper) emitInspected(ctx context.Context, repo *core.Repository, build *core.Build, deadline time.Duration) {
+	r.emit(ctx, &Event{
+		BuildID:  build.ID,
+		RepoID:   repo.ID,
+		Repo:     repo.Slug,
+		Action:   EventSkipped,
+		Reason:   ReasonDeadlineNotReached,
+		Deadline: deadline,
+		Created:  time.Now().Unix(),
+	})
+}
+
+// policies returns the configured Policies, or DefaultPolicy if none
+// are configured.
+func (r *Reaper) policies() []ReapPolicy {
+	if len(r.Policies) == 0 {
+		return defaultPolicies
+	}
+	return r.Policies
+}
+
+// resetPolicies resets any configured policy that carries state
+// between reap ticks, such as MaxConcurrentCancelsPolicy.
+func (r *Reaper) resetPolicies() {
+	for _, policy := range r.policies() {
+		if resettable, ok := policy.(resettablePolicy); ok {
+			resettable.Reset()
+		}
+	}
+}
+
+// ErrBuildDone is returned by Kill when the build has already
+// reached a terminal status and there is nothing left to cancel.
+var ErrBuildDone = errors.New("reaper: build has already finished")
+
+// Kill forcibly terminates the build, regardless of its current
+// pending or running duration, and updates the build and all of
+// its stages to a killed status. Unlike reap and reapMaybe, which
+// only act once a build has exceeded its deadline, Kill is intended
+// to be invoked on-demand, for example from an admin-restricted API
+// endpoint (DELETE /api/repos/:owner/:name/builds/:number) that lets
+// an operator terminate a stuck build immediately.
+//
+// Kill does not depend on the Canceler implementation to persist
+// the killed status: it sets build.Status (and the status of any
+// stage that has not already finished) to StatusKilled itself, via
+// Builds.Update and Stages.Update, after Cancel returns. The HTTP
+// route and its admin authorization check are not implemented in
+// this tree, which has no http/routing package of any kind yet to
+// follow the conventions of; they are tracked as a follow-up on top
+// of this method, which is the hook such a handler would call into.
+func (r *Reaper) Kill(ctx context.Context, repo *core.Repository, build *core.Build) error {
+	if build.IsDone() {
+		return ErrBuildDone
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"repo":  repo.Slug,
+		"build": build.Number,
+	}).Infoln("reaper: killing build on demand")
+
+	if err := r.Canceler.Cancel(ctx, repo, build); err != nil {
 		return err
 	}
 
-	// if the build status is pending we can immediately
-	// cancel the build and all build stages.
-	if build.Status == core.StatusPending {
-		// TODO trace log entry
-		return r.Canceler.Cancel(ctx, repo, build)
+	return r.killStatus(ctx, build)
+}
+
+// killStatus forces the build, and any of its stages that have not
+// already reached a terminal status, to StatusKilled.
+func (r *Reaper) killStatus(ctx context.Context, build *core.Build) error {
+	var result *multierror.Error
+
+	build.Status = core.StatusKilled
+	build.Finished = time.Now().Unix()
+	if err := r.Builds.Update(ctx, build); err != nil {
+		result = multierror.Append(result, err)
 	}
 
 	stages, err := r.Stages.List(ctx, build.ID)
 	if err != nil {
-		return err
+		return multierror.Append(result, err).ErrorOrNil()
 	}
-
-	var started int64
 	for _, stage := range stages {
 		if stage.IsDone() {
 			continue
 		}
-		if stage.Started > started {
-			started = stage.Started
+		stage.Status = core.StatusKilled
+		if err := r.Stages.Update(ctx, stage); err != nil {
+			result = multierror.Append(result, err)
 		}
 	}
+	return result.ErrorOrNil()
+}
 
-	// if the build stages are all pending we can immediately
-	// cancel the build.
-	if started == 0 {
-		// TODO trace log entry
-		return r.Canceler.Cancel(ctx, repo, build)
+// pendingTimeout returns the effective pending deadline for the
+// repository, preferring the repository's own PendingTimeout, then
+// falling back to its QueueTimeout (typically inherited from the
+// repository's default pipeline configuration), and finally to the
+// Reaper's global Pending default.
+func (r *Reaper) pendingTimeout(repo *core.Repository) time.Duration {
+	switch {
+	case repo.PendingTimeout > 0:
+		return repo.PendingTimeout
+	case repo.QueueTimeout > 0:
+		return repo.QueueTimeout
+	default:
+		return r.Pending
 	}
+}
 
-	// if the build stage has exceeded the timeout by a reasonable
-	// margin cancel the build and all build stages, else ignore.
-	if isExceeded(started, time.Duration(repo.Timeout)*time.Minute, buffer) {
-		// TODO trace log entry
-		return r.Canceler.Cancel(ctx, repo, build)
+func (r *Reaper) reapMaybe(ctx context.Context, repo *core.Repository, build *core.Build, deadline time.Duration) error {
+	var stages []*core.Stage
+	if build.Status != core.StatusPending {
+		var err error
+		stages, err = r.Stages.List(ctx, build.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var action Action
+	var reason EventReason
+	applied := deadline
+	for _, policy := range r.policies() {
+		action, reason, applied = policy.Evaluate(ctx, repo, build, stages, deadline)
+		if action != ActionNone {
+			break
+		}
 	}
 
-	// TODO trace log entry
-	return nil
+	// applied reflects the deadline the winning policy actually used
+	// to make its decision, which for a stage timeout is derived
+	// from repo.Timeout rather than the pending/running deadline
+	// passed in.
+	event := &Event{
+		BuildID:  build.ID,
+		RepoID:   repo.ID,
+		Repo:     repo.Slug,
+		Reason:   reason,
+		Deadline: applied,
+		Created:  time.Now().Unix(),
+	}
+
+	switch action {
+	case ActionCancel:
+		event.Action = EventCancelled
+		r.emit(ctx, event)
+		return r.Canceler.Cancel(ctx, repo, build)
+	case ActionDryRun:
+		event.Action = EventDryRun
+		r.emit(ctx, event)
+		return nil
+	default:
+		event.Action = EventSkipped
+		r.emit(ctx, event)
+		return nil
+	}
 }
@@ -0,0 +1,237 @@
+// Copyright 2019 Drone IO, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reaper
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drone/drone/core"
+)
+
+type mockRepoStore struct{}
+
+func (mockRepoStore) Find(ctx context.Context, id int64) (*core.Repository, error) {
+	return &core.Repository{ID: id}, nil
+}
+
+type mockStageStore struct{}
+
+func (mockStageStore) List(ctx context.Context, buildID int64) ([]*core.Stage, error) {
+	return nil, nil
+}
+
+func (mockStageStore) Update(ctx context.Context, stage *core.Stage) error {
+	return nil
+}
+
+type mockCanceler struct{}
+
+func (mockCanceler) Cancel(ctx context.Context, repo *core.Repository, build *core.Build) error {
+	return nil
+}
+
+// slowBuildStore tracks how many calls to Pending are in flight at
+// once, so tests can assert that reap passes never overlap.
+type slowBuildStore struct {
+	sleep time.Duration
+
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (s *slowBuildStore) Pending(ctx context.Context) ([]*core.Build, error) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxSeen {
+		s.maxSeen = s.active
+	}
+	s.mu.Unlock()
+
+	time.Sleep(s.sleep)
+
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return nil, nil
+}
+
+func (s *slowBuildStore) Running(ctx context.Context) ([]*core.Build, error) {
+	return nil, nil
+}
+
+func (s *slowBuildStore) Update(ctx context.Context, build *core.Build) error {
+	return nil
+}
+
+// freshBuildStore returns a single pending build that was just
+// created, so it is nowhere near its deadline.
+type freshBuildStore struct{}
+
+func (freshBuildStore) Pending(ctx context.Context) ([]*core.Build, error) {
+	return []*core.Build{{ID: 1, RepoID: 1, Status: core.StatusPending, Created: time.Now().Unix()}}, nil
+}
+
+func (freshBuildStore) Running(ctx context.Context) ([]*core.Build, error) {
+	return nil, nil
+}
+
+func (freshBuildStore) Update(ctx context.Context, build *core.Build) error {
+	return nil
+}
+
+// recordingStageStore hands back a fixed set of stages and records
+// any updates made to them, so tests can assert on the status Kill
+// leaves behind.
+type recordingStageStore struct {
+	stages []*core.Stage
+}
+
+func (s *recordingStageStore) List(ctx context.Context, buildID int64) ([]*core.Stage, error) {
+	return s.stages, nil
+}
+
+func (s *recordingStageStore) Update(ctx context.Context, stage *core.Stage) error {
+	for _, existing := range s.stages {
+		if existing.ID == stage.ID {
+			*existing = *stage
+		}
+	}
+	return nil
+}
+
+// recordingBuildStore records the last build passed to Update.
+type recordingBuildStore struct {
+	updated *core.Build
+}
+
+func (s *recordingBuildStore) Pending(ctx context.Context) ([]*core.Build, error) {
+	return nil, nil
+}
+
+func (s *recordingBuildStore) Running(ctx context.Context) ([]*core.Build, error) {
+	return nil, nil
+}
+
+func (s *recordingBuildStore) Update(ctx context.Context, build *core.Build) error {
+	s.updated = build
+	return nil
+}
+
+// TestKillSetsKilledStatus verifies that Kill forces the build and
+// its unfinished stages to StatusKilled, independent of whatever the
+// Canceler implementation itself does.
+func TestKillSetsKilledStatus(t *testing.T) {
+	builds := &recordingBuildStore{}
+	stages := &recordingStageStore{stages: []*core.Stage{
+		{ID: 1, BuildID: 1, Status: core.StatusRunning},
+		{ID: 2, BuildID: 1, Status: core.StatusSuccess},
+	}}
+	r := New(mockRepoStore{}, builds, stages, mockCanceler{}, 0, 0)
+
+	repo := &core.Repository{ID: 1, Slug: "octocat/hello-world"}
+	build := &core.Build{ID: 1, Number: 42, Status: core.StatusRunning}
+
+	if err := r.Kill(context.Background(), repo, build); err != nil {
+		t.Fatalf("Kill returned error: %v", err)
+	}
+
+	if build.Status != core.StatusKilled {
+		t.Fatalf("expected the build status to be killed, got %q", build.Status)
+	}
+	if builds.updated == nil || builds.updated.Status != core.StatusKilled {
+		t.Fatalf("expected Builds.Update to persist the killed status")
+	}
+	if stages.stages[0].Status != core.StatusKilled {
+		t.Fatalf("expected the unfinished stage to be killed, got %q", stages.stages[0].Status)
+	}
+	if stages.stages[1].Status != core.StatusSuccess {
+		t.Fatalf("expected the already-finished stage to be left alone, got %q", stages.stages[1].Status)
+	}
+}
+
+// TestKillRejectsFinishedBuild verifies Kill refuses to act on a
+// build that has already reached a terminal status.
+func TestKillRejectsFinishedBuild(t *testing.T) {
+	r := New(mockRepoStore{}, &recordingBuildStore{}, &recordingStageStore{}, mockCanceler{}, 0, 0)
+
+	repo := &core.Repository{ID: 1, Slug: "octocat/hello-world"}
+	build := &core.Build{ID: 1, Number: 42, Status: core.StatusSuccess}
+
+	if err := r.Kill(context.Background(), repo, build); err != ErrBuildDone {
+		t.Fatalf("expected ErrBuildDone, got %v", err)
+	}
+}
+
+// TestReapEmitsInspectedEvent verifies that a build inspected but
+// found within its deadline still produces an event, not just the
+// builds that are actually skipped or cancelled by a ReapPolicy.
+func TestReapEmitsInspectedEvent(t *testing.T) {
+	r := New(mockRepoStore{}, freshBuildStore{}, mockStageStore{}, mockCanceler{}, time.Hour, time.Hour)
+
+	if err := r.reap(context.Background()); err != nil {
+		t.Fatalf("reap returned error: %v", err)
+	}
+
+	recent := r.Recent()
+	if len(recent) != 1 {
+		t.Fatalf("expected exactly one event, got %d", len(recent))
+	}
+	if recent[0].Action != EventSkipped || recent[0].Reason != ReasonDeadlineNotReached {
+		t.Fatalf("expected a skipped/deadline_not_reached event, got %v/%v", recent[0].Action, recent[0].Reason)
+	}
+}
+
+// TestStartStop verifies that Stop blocks until Start has returned,
+// and that Start returns promptly once any in-progress reap pass has
+// finished. Run with -race: Stop and the ticker loop inside Start
+// race on the same goroutine lifecycle and previously tripped the
+// WaitGroup's Add-concurrent-with-Wait misuse check.
+func TestStartStop(t *testing.T) {
+	store := &slowBuildStore{sleep: 5 * time.Millisecond}
+	r := New(mockRepoStore{}, store, mockStageStore{}, mockCanceler{}, 0, 0)
+
+	started := make(chan error, 1)
+	go func() {
+		started <- r.Start(context.Background(), time.Millisecond)
+	}()
+
+	// let a few ticks fire, overlapping with the Stop call below.
+	time.Sleep(20 * time.Millisecond)
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Stop(stopCtx); err != nil {
+		t.Fatalf("Stop returned error: %v", err)
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Start returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.maxSeen > 1 {
+		t.Fatalf("expected reap passes to never overlap, saw %d concurrent passes", store.maxSeen)
+	}
+}